@@ -5,19 +5,34 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"go/build"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/howeyc/fsnotify"
+	"golang.org/x/net/websocket"
+	"golang.org/x/perf/benchstat"
 )
 
 var (
@@ -26,8 +41,40 @@ var (
 	neverRun     bool
 	raceDetector bool
 	buildTags    string
+	watchDirs    stringList
+	ignoreGlobs  stringList
+	debounce     time.Duration
+	watchExts    string
+	configPath   string
+	onlyStages   stringList
+	skipStages   stringList
+	reloadAddr   string
+	injectScript bool
+	stopSignal   string
+	stopTimeout  time.Duration
+	readyProbe   string
+	readyTimeout time.Duration
+	overlap      bool
+	target       string
+	goos         string
+	goarch       string
+	benchRegex   string
+	benchCount   int
+	benchThresh  float64
 )
 
+// stringList collects repeatable flags (e.g. --watch, --ignore) into a slice.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 func main() {
 
 	flag.BoolVar(&doTests, "test", false, "Run tests (before running program)")
@@ -35,9 +82,33 @@ func main() {
 	flag.StringVar(&buildTags, "build-tags", "", "Build tags")
 	flag.BoolVar(&neverRun, "no-run", false, "Do not run")
 	flag.BoolVar(&raceDetector, "race", false, "Run program and tests with the race detector")
+	flag.Var(&watchDirs, "watch", "Additional directory to watch recursively (repeatable)")
+	flag.Var(&ignoreGlobs, "ignore", "Glob matched against directory base names to skip while watching (repeatable, defaults to vendor, .git, node_modules, testdata)")
+	flag.DurationVar(&debounce, "debounce", 300*time.Millisecond, "Coalesce filesystem events within this window into a single rebuild")
+	flag.StringVar(&watchExts, "ext", ".go", "Comma-separated list of file extensions that trigger a rebuild")
+	flag.StringVar(&configPath, "config", "", "Path to a rerun.toml pipeline config")
+	flag.Var(&onlyStages, "only", "Run only this pipeline stage (repeatable)")
+	flag.Var(&skipStages, "skip", "Skip this pipeline stage (repeatable)")
+	flag.StringVar(&reloadAddr, "reload-addr", "", "Address for a live-reload HTTP+WebSocket server, e.g. :35729")
+	flag.BoolVar(&injectScript, "inject-script", false, "Serve a reload-triggering script at /rerun.js")
+	flag.StringVar(&stopSignal, "stop-signal", "SIGINT", "Signal sent to stop the running process: SIGTERM, SIGINT or SIGHUP")
+	flag.DurationVar(&stopTimeout, "stop-timeout", 5*time.Second, "How long to wait after --stop-signal before hard-killing the process")
+	flag.StringVar(&readyProbe, "ready-probe", "", "HTTP URL that must return 200 before the new process is considered up")
+	flag.DurationVar(&readyTimeout, "ready-timeout", 10*time.Second, "How long to wait for --ready-probe to succeed")
+	flag.BoolVar(&overlap, "overlap", false, "Start the new process before stopping the old one, instead of stop-then-start")
+	flag.StringVar(&target, "target", "", "user@host:/remote/path to cross-compile, deploy and run the binary on")
+	flag.StringVar(&goos, "goos", "", "GOOS to build for (used with --target)")
+	flag.StringVar(&goarch, "goarch", "", "GOARCH to build for (used with --target)")
+	flag.StringVar(&benchRegex, "bench", "", "Run benchmarks matching this regex after each successful rebuild")
+	flag.IntVar(&benchCount, "bench-count", 5, "Number of times to run each benchmark (go test -count)")
+	flag.Float64Var(&benchThresh, "bench-threshold", 5.0, "Percent change, in either direction, vs the previous run that's highlighted in red")
 
 	flag.Parse()
 
+	if len(ignoreGlobs) == 0 {
+		ignoreGlobs = stringList{"vendor", ".git", "node_modules", "testdata"}
+	}
+
 	if len(flag.Args()) < 1 {
 		log.Fatal("Usage: rerun [--test] [--no-run] [--build] [--race] <import path> [arg]*")
 	}
@@ -136,76 +207,856 @@ func gobuild(buildpath string) (passed bool, err error) {
 	return
 }
 
-var runch = make(chan bool)
+// crossCompileEnv overrides GOOS/GOARCH on top of the current environment,
+// used to cross-compile the binary for --target.
+func crossCompileEnv(goos, goarch string) []string {
+	env := os.Environ()
+	if goos != "" {
+		env = append(env, "GOOS="+goos)
+	}
+	if goarch != "" {
+		env = append(env, "GOARCH="+goarch)
+	}
+	return env
+}
 
-func run(binName, binPath string, args []string) {
-	cmdline := append([]string{binName}, args...)
-	var proc *os.Process
-	restarting := false
+// buildBin produces the binary that will actually be run: a plain
+// `go get` into binPath for local execution, or, under --target, a
+// cross-compiled `go build -o binPath` for --goos/--goarch so the
+// artifact deployed to the remote host matches its architecture.
+func buildBin(buildpath, binPath, lastError string) (built bool, errorOutput string, err error) {
+	if target != "" {
+		return crossBuild(buildpath, binPath, lastError)
+	}
+	_, errorOutput, err = install(buildpath, lastError)
+	return err == nil, errorOutput, err
+}
+
+// crossBuild is install()'s counterpart for --target: it cross-compiles
+// buildpath for --goos/--goarch directly to binPath, so deploy() ships the
+// right architecture instead of whatever install() would have produced for
+// the host.
+func crossBuild(buildpath, binPath, lastError string) (built bool, errorOutput string, err error) {
+	cmdline := []string{"go", "build"}
+
+	if buildTags != "" {
+		cmdline = append(cmdline, "-tags", buildTags)
+	}
+	if raceDetector {
+		cmdline = append(cmdline, "-race")
+	}
+	cmdline = append(cmdline, "-o", binPath, buildpath)
+
+	cmd := exec.Command("go", cmdline[1:]...)
+	cmd.Env = crossCompileEnv(goos, goarch)
+	buf := bytes.NewBuffer([]byte{})
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+
+	err = cmd.Run()
+
+	if err != nil || buf.Len() > 0 {
+		errorOutput = buf.String()
+		if errorOutput != lastError {
+			fmt.Print(errorOutput)
+		}
+		if err == nil {
+			err = errors.New("compile error")
+		}
+		return false, errorOutput, err
+	}
+
+	return true, "", nil
+}
+
+// Stage is one step of a Pipeline, e.g. "test", "build" or a user-defined
+// stage such as "generate" or "vet" loaded from a rerun.toml config.
+type Stage interface {
+	Name() string
+	Run() (passed bool, err error)
+}
+
+// funcStage adapts the built-in test/gobuild functions to the Stage
+// interface, used when no --config is given.
+type funcStage struct {
+	name string
+	fn   func(buildpath string) (bool, error)
+	path string
+}
+
+func (s funcStage) Name() string       { return s.name }
+func (s funcStage) Run() (bool, error) { return s.fn(s.path) }
+
+// configStage is a Stage loaded from rerun.toml: a shell command with
+// optional pre_run/post_run hooks.
+type configStage struct {
+	name    string
+	cmd     string
+	preRun  string
+	postRun string
+}
+
+func (s configStage) Name() string { return s.name }
+
+func (s configStage) Run() (passed bool, err error) {
+	if s.preRun != "" {
+		if _, err = runShell(s.preRun); err != nil {
+			return false, err
+		}
+	}
+	_, err = runShell(s.cmd)
+	if err != nil {
+		return false, err
+	}
+	if s.postRun != "" {
+		if _, err = runShell(s.postRun); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Pipeline runs an ordered sequence of Stages, short-circuiting on the
+// first failure (matching the existing noRun behavior) and reporting each
+// stage's pass/fail and elapsed time through logln.
+type Pipeline struct {
+	stages []Stage
+	only   map[string]bool
+	skip   map[string]bool
+}
+
+func (p *Pipeline) enabled(name string) bool {
+	if len(p.only) > 0 {
+		return p.only[name]
+	}
+	return !p.skip[name]
+}
+
+func (p *Pipeline) Run() bool {
+	for _, s := range p.stages {
+		if !p.enabled(s.Name()) {
+			continue
+		}
+		start := time.Now()
+		passed, err := s.Run()
+		elapsed := time.Since(start)
+		if !passed {
+			logf("%s: FAILED (%s): %s", s.Name(), elapsed, err)
+			return false
+		}
+		logf("%s: passed (%s)", s.Name(), elapsed)
+	}
+	return true
+}
+
+// defaultPipeline reproduces rerun's historical behavior (an optional test
+// stage followed by an optional build stage) as a Pipeline, for use when no
+// --config is given. only/skip are applied the same way loadPipeline applies
+// them, so --only/--skip still mean something without --config.
+func defaultPipeline(buildpath string, only, skip []string) *Pipeline {
+	p := &Pipeline{only: toSet(only), skip: toSet(skip)}
+	if doTests {
+		p.stages = append(p.stages, funcStage{name: "test", fn: test, path: buildpath})
+	}
+	if doBuild {
+		p.stages = append(p.stages, funcStage{name: "build", fn: gobuild, path: buildpath})
+	}
+	return p
+}
+
+type pipelineConfig struct {
+	Stage []struct {
+		Name    string `toml:"name"`
+		Cmd     string `toml:"cmd"`
+		PreRun  string `toml:"pre_run"`
+		PostRun string `toml:"post_run"`
+	} `toml:"stage"`
+}
+
+// loadPipeline reads a rerun.toml pipeline config and applies --only/--skip
+// stage selection. It returns nil (not an error) when configPath is empty,
+// so callers fall back to defaultPipeline.
+func loadPipeline(configPath string, only, skip []string) (*Pipeline, error) {
+	if configPath == "" {
+		return nil, nil
+	}
+
+	var cfg pipelineConfig
+	if _, err := toml.DecodeFile(configPath, &cfg); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", configPath, err)
+	}
+
+	p := &Pipeline{only: toSet(only), skip: toSet(skip)}
+	for _, s := range cfg.Stage {
+		p.stages = append(p.stages, configStage{name: s.Name, cmd: s.Cmd, preRun: s.PreRun, postRun: s.PostRun})
+	}
+	return p, nil
+}
+
+func toSet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, v := range list {
+		set[v] = true
+	}
+	return set
+}
+
+// runShell runs cmdline through the shell, capturing combined stdout/stderr
+// and printing it when the command fails.
+func runShell(cmdline string) (string, error) {
+	cmd := exec.Command("sh", "-c", cmdline)
+	buf := bytes.NewBuffer([]byte{})
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+
+	err := cmd.Run()
+	if err != nil {
+		fmt.Print(buf)
+	}
+	return buf.String(), err
+}
+
+// reloadServer broadcasts a "reload" message to every connected browser
+// over WebSocket whenever a rebuild succeeds, and optionally serves the JS
+// snippet that wires a page up to it.
+type reloadServer struct {
+	mu      sync.Mutex
+	clients map[*websocket.Conn]bool
+}
+
+func newReloadServer() *reloadServer {
+	return &reloadServer{clients: make(map[*websocket.Conn]bool)}
+}
+
+func (s *reloadServer) handle(ws *websocket.Conn) {
+	s.mu.Lock()
+	s.clients[ws] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, ws)
+		s.mu.Unlock()
+		ws.Close()
+	}()
+
+	// block until the browser disconnects; we only ever write to ws.
+	io.Copy(ioutil.Discard, ws)
+}
+
+func (s *reloadServer) broadcast(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ws := range s.clients {
+		if _, err := ws.Write([]byte(msg)); err != nil {
+			ws.Close()
+			delete(s.clients, ws)
+		}
+	}
+}
+
+// listenAndServe starts the reload server in the background. Errors are
+// logged rather than returned since the watch loop should keep running
+// even if the reload addr is bad or already in use.
+func (s *reloadServer) listenAndServe(addr string, serveInjectScript bool) {
+	mux := http.NewServeMux()
+	mux.Handle("/reload", websocket.Handler(s.handle))
+	if serveInjectScript {
+		mux.HandleFunc("/rerun.js", injectScriptHandler(addr))
+	}
 	go func() {
-		for {
-			time.Sleep(time.Second)
-			if restarting {
-				continue
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logf("reload-addr %s: %s", addr, err)
+		}
+	}()
+}
+
+const injectScriptTmpl = `(function() {
+	var ws = new WebSocket("ws://" + location.hostname + ":%s/reload");
+	ws.onmessage = function() { location.reload(); };
+})();
+`
+
+// injectScriptHandler serves the JS snippet that reconnects a page to the
+// reload server listening on addr and reloads the page on every message.
+func injectScriptHandler(addr string) http.HandlerFunc {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		port = addr
+	}
+	body := fmt.Sprintf(injectScriptTmpl, port)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		io.WriteString(w, body)
+	}
+}
+
+const benchLogPath = ".rerun/bench.jsonl"
+
+// benchEntry is one line of .rerun/bench.jsonl: a source-tree hash paired
+// with the raw `go test -bench` output taken at that hash.
+type benchEntry struct {
+	Hash   string `json:"hash"`
+	Time   string `json:"time"`
+	Output string `json:"output"`
+}
+
+// runBench runs --bench's benchmarks, prints a delta table against the
+// previous entry in .rerun/bench.jsonl, and appends the new result.
+func runBench(buildpath string) {
+	if benchRegex == "" {
+		return
+	}
+
+	hash, err := hashTree(buildpath)
+	if err != nil {
+		logf("bench: hashing source tree: %s", err)
+		return
+	}
+
+	cmd := exec.Command("go", "test", "-run=^$", "-bench="+benchRegex, "-benchmem", fmt.Sprintf("-count=%d", benchCount), buildpath)
+	buf := bytes.NewBuffer([]byte{})
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+	if err := cmd.Run(); err != nil {
+		fmt.Print(buf)
+		logf("bench: %s", err)
+		return
+	}
+
+	prev, err := lastBenchEntry(benchLogPath, hash)
+	if err != nil {
+		logf("bench: reading %s: %s", benchLogPath, err)
+	}
+
+	printBenchDelta(prev, buf.Bytes())
+
+	entry := benchEntry{Hash: hash, Time: time.Now().Format(time.RFC3339), Output: buf.String()}
+	if err := appendBenchEntry(benchLogPath, entry); err != nil {
+		logf("bench: writing %s: %s", benchLogPath, err)
+	}
+}
+
+// hashTree hashes the contents of every --ext file under watchRoots(buildpath),
+// i.e. the same directories getWatcher watches, used to key .rerun/bench.jsonl
+// entries.
+func hashTree(buildpath string) (string, error) {
+	roots, err := watchRoots(buildpath)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, root := range roots {
+		err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
 			}
-			if proc == nil {
-				logln("process quit, relauch")
-				runch <- true
-				continue
+			if info.IsDir() {
+				if isIgnored(p) {
+					return filepath.SkipDir
+				}
+				return nil
 			}
-			ps, err := proc.Wait()
+			if !isWatchedExt(p) {
+				return nil
+			}
+			data, err := ioutil.ReadFile(p)
 			if err != nil {
-				logln("000", err, ps)
+				return err
 			}
-			proc = nil
+			io.WriteString(h, p)
+			h.Write(data)
+			return nil
+		})
+		if err != nil {
+			return "", err
 		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// lastBenchEntry returns the most recent entry in logPath whose Hash
+// differs from hash, i.e. the last distinct source revision benchmarked
+// before the current one. Entries that share hash (a rebuild with no
+// source change) are skipped so they're never compared against themselves.
+func lastBenchEntry(logPath, hash string) (*benchEntry, error) {
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if lines[i] == "" {
+			continue
+		}
+		var entry benchEntry
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			return nil, err
+		}
+		if entry.Hash == hash {
+			continue
+		}
+		return &entry, nil
+	}
+	return nil, nil
+}
+
+func appendBenchEntry(logPath string, entry benchEntry) error {
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+const (
+	ansiRed   = "\x1b[31m"
+	ansiReset = "\x1b[0m"
+)
+
+// printBenchDelta uses benchstat to compare the previous run's output
+// against curOutput, printing each benchmark's delta and highlighting in
+// red anything past --bench-threshold percent.
+func printBenchDelta(prev *benchEntry, curOutput []byte) {
+	var c benchstat.Collection
+	if prev != nil {
+		c.AddConfig("previous", []byte(prev.Output))
+	}
+	c.AddConfig("current", curOutput)
+
+	for _, table := range c.Tables() {
+		for _, row := range table.Rows {
+			line := fmt.Sprintf("%-30s %s", row.Benchmark, row.Delta)
+			if math.Abs(row.PctDelta) > benchThresh {
+				line = ansiRed + line + ansiReset
+			}
+			logln(line)
+		}
+	}
+}
+
+var runch = make(chan bool)
+
+// managedProc pairs a running process with a channel that's closed once its
+// exit is reaped. done is closed, not sent on, so both an intentional stop
+// (stopManaged) and the crash watcher (crashWatch) can each receive from it
+// without racing over who gets the single value.
+type managedProc struct {
+	proc *os.Process
+	done chan struct{}
+}
+
+func launchManaged(binName, binPath string, args []string) *managedProc {
+	cmd := exec.Command(binPath, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	logln("launch", binPath)
+	log.Print(append([]string{binName}, args...))
+
+	if err := cmd.Start(); err != nil {
+		logf("error on starting process: '%s'", err)
+		return nil
+	}
+
+	mp := &managedProc{proc: cmd.Process, done: make(chan struct{})}
+	go func() {
+		mp.proc.Wait()
+		close(mp.done)
 	}()
-	for relaunch := range runch {
-		logln("launch", binPath)
-		restarting = true
-		defer func() { restarting = false }()
-		if proc != nil {
-			err := proc.Signal(os.Interrupt)
-			if err != nil {
-				logf("error on sending signal to process: '%s', will now hard-kill the process", err)
-				proc.Kill()
+	return mp
+}
+
+// resolveStopSignal maps --stop-signal to an os.Signal, falling back to
+// SIGINT (the previous hard-coded behavior) on an unrecognized name.
+func resolveStopSignal() os.Signal {
+	switch strings.ToUpper(stopSignal) {
+	case "SIGTERM", "TERM":
+		return syscall.SIGTERM
+	case "SIGINT", "INT":
+		return syscall.SIGINT
+	case "SIGHUP", "HUP":
+		return syscall.SIGHUP
+	default:
+		logf("unknown --stop-signal %q, falling back to SIGINT", stopSignal)
+		return syscall.SIGINT
+	}
+}
+
+// stopManaged signals mp to stop and waits for it to exit, hard-killing it
+// once --stop-timeout elapses instead of blocking forever. A --stop-timeout
+// of zero or less waits for the process to exit with no hard-kill.
+func stopManaged(mp *managedProc) {
+	if mp == nil {
+		return
+	}
+	if err := mp.proc.Signal(resolveStopSignal()); err != nil {
+		logf("error sending %s to process: '%s', will now hard-kill the process", stopSignal, err)
+		mp.proc.Kill()
+		<-mp.done
+		return
+	}
+
+	if stopTimeout <= 0 {
+		<-mp.done
+		return
+	}
+	select {
+	case <-mp.done:
+	case <-time.After(stopTimeout):
+		logf("process did not stop within %s, hard-killing", stopTimeout)
+		mp.proc.Kill()
+		<-mp.done
+	}
+}
+
+// waitReady polls url until it returns 200 or timeout elapses.
+func waitReady(url string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return true
 			}
-			proc.Wait()
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return false
+}
+
+// runner is the state machine behind the running process: at most one
+// managedProc is "current" at a time, protected by mu, replacing the old
+// racy proc variable and restarting bool.
+type runner struct {
+	mu      sync.Mutex
+	current *managedProc
+}
+
+// crashWatch relaunches the process if it exits on its own, but does
+// nothing if mp was stopped intentionally (stop/restart clear r.current,
+// under mu, before they ever signal mp to exit).
+func (r *runner) crashWatch(mp *managedProc) {
+	<-mp.done
+	r.mu.Lock()
+	isCurrent := r.current == mp
+	if isCurrent {
+		r.current = nil
+	}
+	r.mu.Unlock()
+	if isCurrent {
+		logln("process quit, relaunch")
+		runch <- true
+	}
+}
+
+func (r *runner) stop() {
+	r.mu.Lock()
+	mp := r.current
+	r.current = nil
+	r.mu.Unlock()
+	stopManaged(mp)
+}
+
+// restart launches the new process, gates it on --ready-probe if set, and
+// stops the old one either before (default) or after (--overlap) the new
+// one comes up.
+func (r *runner) restart(binName, binPath string, args []string) {
+	r.mu.Lock()
+	old := r.current
+	r.current = nil
+	r.mu.Unlock()
+
+	// startNew assigns r.current as soon as the process is launched, before
+	// crashWatch/waitReady run, so a crash during the ready-probe wait is
+	// still seen as "this is r.current" and triggers a relaunch instead of
+	// being silently dropped.
+	startNew := func() {
+		mp := launchManaged(binName, binPath, args)
+		r.mu.Lock()
+		r.current = mp
+		r.mu.Unlock()
+		if mp == nil {
+			return
+		}
+		go r.crashWatch(mp)
+		if readyProbe != "" && !waitReady(readyProbe, readyTimeout) {
+			logf("ready-probe %s did not succeed within %s", readyProbe, readyTimeout)
+		}
+	}
+
+	if overlap {
+		startNew()
+		stopManaged(old)
+		return
+	}
+
+	stopManaged(old)
+	startNew()
+}
+
+func run(binName, binPath string, args []string) {
+	r := &runner{}
+	for relaunch := range runch {
+		if !relaunch {
+			r.stop()
+			continue
+		}
+		r.restart(binName, binPath, args)
+	}
+}
+
+// remoteTarget is a parsed --target "user@host:/remote/path".
+type remoteTarget struct {
+	userHost  string
+	remoteDir string
+}
+
+func parseTarget(raw string) remoteTarget {
+	if i := strings.Index(raw, ":"); i >= 0 {
+		return remoteTarget{userHost: raw[:i], remoteDir: raw[i+1:]}
+	}
+	return remoteTarget{userHost: raw}
+}
+
+func (t remoteTarget) remotePath(binName string) string {
+	return path.Join(t.remoteDir, binName)
+}
+
+// deploy rsyncs the freshly cross-compiled binPath to t.
+func deploy(binPath, binName string, t remoteTarget) error {
+	dest := fmt.Sprintf("%s:%s", t.userHost, t.remotePath(binName))
+	cmd := exec.Command("rsync", "-az", binPath, dest)
+	buf := bytes.NewBuffer([]byte{})
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+	if err := cmd.Run(); err != nil {
+		fmt.Print(buf)
+		return err
+	}
+	return nil
+}
+
+// startRemote runs binName over ssh on t, streaming its stdout/stderr back
+// through logln, and returns the remote pid so a later restart can kill it.
+// "echo $$; exec ..." reports the shell's own pid and then exec's into the
+// binary in place of that shell, so the pid stays valid for the lifetime
+// of the remote process.
+func startRemote(t remoteTarget, binName string, args []string) (pid string, err error) {
+	cmdline := append([]string{t.remotePath(binName)}, args...)
+	remoteCmd := fmt.Sprintf("echo $$; exec %s", strings.Join(shellQuote(cmdline), " "))
+
+	cmd := exec.Command("ssh", t.userHost, remoteCmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return "", err
+	}
+
+	reader := bufio.NewReader(stdout)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	pid = strings.TrimSpace(line)
+
+	logLines := func(r io.Reader) {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			logln(scanner.Text())
+		}
+	}
+	go logLines(reader)
+	go logLines(stderr)
+	go cmd.Wait()
+	return pid, nil
+}
+
+func stopRemote(t remoteTarget, pid string) {
+	if pid == "" {
+		return
+	}
+	exec.Command("ssh", t.userHost, "kill", pid).Run()
+}
+
+func shellQuote(args []string) []string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+	}
+	return quoted
+}
+
+// runRemote is run()'s counterpart for --target: it deploys the binary and
+// runs it over ssh instead of executing it locally.
+func runRemote(binName, binPath string, args []string, t remoteTarget) {
+	var pid string
+	for relaunch := range runch {
+		if pid != "" {
+			stopRemote(t, pid)
+			pid = ""
 		}
 		if !relaunch {
 			continue
 		}
-		cmd := exec.Command(binPath, args...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		log.Print(cmdline)
-		err := cmd.Start()
+		if err := deploy(binPath, binName, t); err != nil {
+			logf("deploy to %s failed: %s", t.userHost, err)
+			continue
+		}
+		newPid, err := startRemote(t, binName, args)
 		if err != nil {
-			logf("error on starting process: '%s'", err)
+			logf("error starting remote process on %s: %s", t.userHost, err)
+			continue
 		}
-		proc = cmd.Process
+		pid = newPid
+		logln("running on", t.userHost, "pid", pid)
 	}
 }
 
-func getWatcher(buildpath string) (watcher *fsnotify.Watcher, err error) {
-	watcher, err = fsnotify.NewWatcher()
-	addToWatcher(watcher, buildpath, map[string]bool{})
-	return
+// watchRoots returns every directory that should be walked recursively: the
+// module root (buildpath's repo, not just buildpath's own leaf directory,
+// so sibling non-Go trees like templates/ or migrations/ are covered even
+// when main lives at a leaf such as cmd/app) plus any directories passed
+// via --watch.
+func watchRoots(buildpath string) ([]string, error) {
+	pkg, err := build.Import(buildpath, "", build.FindOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := append([]string{moduleRoot(pkg)}, watchDirs...)
+	return roots, nil
 }
 
-func addToWatcher(watcher *fsnotify.Watcher, importpath string, watching map[string]bool) {
-	pkg, err := build.Import(importpath, "", 0)
+// moduleRoot guesses the repo root for pkg: for a GOPATH-style import path
+// host/org/repo/... (e.g. "github.com/org/repo/cmd/app") that's the
+// host/org/repo directory. Anything else (no such prefix, or it doesn't
+// resolve to a real directory) falls back to pkg.Dir itself.
+func moduleRoot(pkg *build.Package) string {
+	parts := strings.Split(pkg.ImportPath, "/")
+	if len(parts) >= 3 && strings.Contains(parts[0], ".") {
+		repoImport := strings.Join(parts[:3], "/")
+		if repoPkg, err := build.Import(repoImport, "", build.FindOnly); err == nil {
+			return repoPkg.Dir
+		}
+	}
+	return pkg.Dir
+}
+
+// getWatcher builds a watcher covering every directory from watchRoots,
+// skipping anything matched by --ignore.
+func getWatcher(buildpath string) (watcher *fsnotify.Watcher, err error) {
+	watcher, err = fsnotify.NewWatcher()
 	if err != nil {
 		return
 	}
-	if pkg.Goroot {
+
+	roots, err := watchRoots(buildpath)
+	if err != nil {
 		return
 	}
-	watcher.Watch(pkg.Dir)
-	watching[importpath] = true
-	for _, imp := range pkg.Imports {
-		if !watching[imp] {
-			addToWatcher(watcher, imp, watching)
+
+	for _, root := range roots {
+		if err = watchTree(watcher, root); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// watchTree recursively adds every non-ignored directory under root to watcher.
+func watchTree(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if isIgnored(p) {
+			return filepath.SkipDir
+		}
+		return watcher.Watch(p)
+	})
+}
+
+// isIgnored reports whether p's base name matches one of --ignore's globs.
+func isIgnored(p string) bool {
+	base := filepath.Base(p)
+	for _, glob := range ignoreGlobs {
+		if ok, _ := filepath.Match(glob, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isWatchedExt reports whether name's extension is in the --ext list.
+func isWatchedExt(name string) bool {
+	ext := filepath.Ext(name)
+	for _, e := range strings.Split(watchExts, ",") {
+		if strings.TrimSpace(e) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// watchLoop reads raw fsnotify events, keeps the watcher in sync with newly
+// created directories, and coalesces bursts of matching-extension events
+// within the debounce window into a single rebuild trigger.
+func watchLoop(watcher *fsnotify.Watcher, trigger chan<- string) {
+	var timer *time.Timer
+	fire := make(chan bool, 1)
+	var pending string
+
+	for {
+		select {
+		case we, ok := <-watcher.Event:
+			if !ok {
+				return
+			}
+			if we.IsCreate() {
+				if info, err := os.Stat(we.Name); err == nil && info.IsDir() && !isIgnored(we.Name) {
+					watcher.Watch(we.Name)
+				}
+			}
+			if !isWatchedExt(we.Name) {
+				continue
+			}
+			pending = we.Name
+			if timer == nil {
+				timer = time.AfterFunc(debounce, func() { fire <- true })
+			} else {
+				timer.Reset(debounce)
+			}
+		case <-fire:
+			trigger <- pending
+		case err := <-watcher.Error:
+			logln("watch error:", err)
 		}
 	}
 }
@@ -231,23 +1082,31 @@ func rerun(buildpath string, args []string) (err error) {
 	}
 
 	if !(neverRun) {
-		go run(binName, binPath, args)
+		if target != "" {
+			go runRemote(binName, binPath, args, parseTarget(target))
+		} else {
+			go run(binName, binPath, args)
+		}
 	}
 
-	noRun := false
-	if doTests {
-		passed, _ := test(buildpath)
-		if !passed {
-			noRun = true
-		}
+	pipeline, err := loadPipeline(configPath, onlyStages, skipStages)
+	if err != nil {
+		return err
+	}
+	if pipeline == nil {
+		pipeline = defaultPipeline(buildpath, onlyStages, skipStages)
 	}
 
-	if doBuild && !noRun {
-		gobuild(buildpath)
+	noRun := !pipeline.Run()
+
+	var reloader *reloadServer
+	if reloadAddr != "" {
+		reloader = newReloadServer()
+		reloader.listenAndServe(reloadAddr, injectScript)
 	}
 
 	var errorOutput string
-	_, errorOutput, ierr := install(buildpath, errorOutput)
+	_, errorOutput, ierr := buildBin(buildpath, binPath, errorOutput)
 	if !noRun && !(neverRun) && ierr == nil {
 		runch <- true
 	}
@@ -256,60 +1115,34 @@ func rerun(buildpath string, args []string) (err error) {
 	if err != nil {
 		return err
 	}
+	defer watcher.Close()
 
-	for {
-		// read event from the watcher
-		we, _ := <-watcher.Event
-		// other files in the directory don't count - we watch the whole thing in case new .go files appear.
-		if filepath.Ext(we.Name) != ".go" {
-			continue
-		}
+	trigger := make(chan string)
+	go watchLoop(watcher, trigger)
 
-		logln("change -->", we.Name)
-
-		// close the watcher
-		watcher.Close()
-		// to clean things up: read events from the watcher until events chan is closed.
-		go func(events chan *fsnotify.FileEvent) {
-			for range events {
-
-			}
-		}(watcher.Event)
-		// create a new watcher
-		logln("rescanning")
-		watcher, err = getWatcher(buildpath)
-		if err != nil {
-			return
-		}
-
-		// we don't need the errors from the new watcher.
-		// we continiously discard them from the channel to avoid a deadlock.
-		go func(errors chan error) {
-			for range errors {
-
-			}
-		}(watcher.Error)
+	for {
+		// wait for a debounced, extension-matching change
+		name := <-trigger
+		logln("change -->", name)
 
 		var installed bool
 		// rebuild
-		installed, errorOutput, _ = install(buildpath, errorOutput)
+		installed, errorOutput, _ = buildBin(buildpath, binPath, errorOutput)
 		if !installed {
 			continue
 		}
 
-		if doTests {
-			passed, _ := test(buildpath)
-			if !passed {
-				continue
-			}
+		if !pipeline.Run() {
+			continue
 		}
 
-		if doBuild {
-			gobuild(buildpath)
-		}
+		runBench(buildpath)
 
 		// rerun. if we're only testing, sending
 		if !(neverRun) {
+			if reloader != nil {
+				reloader.broadcast("reload")
+			}
 			runch <- true
 		}
 	}